@@ -10,9 +10,11 @@ package tokenexchange
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"io"
 	"net/http"
 	"net/url"
+	"os"
 	"strings"
 	"time"
 
@@ -20,16 +22,39 @@ import (
 )
 
 const (
-	paramSubjectToken     = "subject_token"
-	paramSubjectTokenType = "subject_token_type"
-	paramGrantType        = "grant_type"
-
-	grantTypeExchange = "urn:ietf:params:oauth:grant-type:token-exchange"
+	paramSubjectToken       = "subject_token"
+	paramSubjectTokenType   = "subject_token_type"
+	paramGrantType          = "grant_type"
+	paramResource           = "resource"
+	paramAudience           = "audience"
+	paramScope              = "scope"
+	paramRequestedTokenType = "requested_token_type"
+	paramActorToken         = "actor_token"
+	paramActorTokenType     = "actor_token_type"
+	paramRefreshToken       = "refresh_token"
+
+	grantTypeExchange     = "urn:ietf:params:oauth:grant-type:token-exchange"
+	grantTypeRefreshToken = "refresh_token"
 )
 
 const (
 	// SubjectTokenTypeJWT represents a JWT subject token type.
 	SubjectTokenTypeJWT = "urn:ietf:params:oauth:token-type:jwt"
+
+	// SubjectTokenTypeAccessToken represents an OAuth 2.0 access token subject or actor token type.
+	SubjectTokenTypeAccessToken = "urn:ietf:params:oauth:token-type:access_token"
+
+	// SubjectTokenTypeRefreshToken represents an OAuth 2.0 refresh token subject or actor token type.
+	SubjectTokenTypeRefreshToken = "urn:ietf:params:oauth:token-type:refresh_token"
+
+	// SubjectTokenTypeIDToken represents an OpenID Connect ID Token subject or actor token type.
+	SubjectTokenTypeIDToken = "urn:ietf:params:oauth:token-type:id_token"
+
+	// SubjectTokenTypeSAML1 represents a base64url-encoded SAML 1.1 assertion subject or actor token type.
+	SubjectTokenTypeSAML1 = "urn:ietf:params:oauth:token-type:saml1"
+
+	// SubjectTokenTypeSAML2 represents a base64url-encoded SAML 2.0 assertion subject or actor token type.
+	SubjectTokenTypeSAML2 = "urn:ietf:params:oauth:token-type:saml2"
 )
 
 type tokenExchangeResponse struct {
@@ -37,6 +62,124 @@ type tokenExchangeResponse struct {
 	IssuedTokenType string `json:"issued_token_type"`
 	TokenType       string `json:"token_type"`
 	ExpiresIn       int    `json:"expires_in"`
+	RefreshToken    string `json:"refresh_token"`
+}
+
+// tokenExchangeErrorResponse represents the RFC 6749 section 5.2 error response body a security
+// token service returns alongside a 4xx/5xx status code.
+type tokenExchangeErrorResponse struct {
+	ErrorCode        string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+	ErrorURI         string `json:"error_uri"`
+}
+
+// RetrieveError is returned when a token exchange request fails, mirroring oauth2.RetrieveError.
+// It carries the raw HTTP response and body alongside the parsed RFC 6749 section 5.2 error
+// fields, when the STS returned them, so callers can distinguish error conditions (e.g.
+// "invalid_grant" meaning the subject token was rejected) from transient failures.
+type RetrieveError struct {
+	// Response is the HTTP response returned by the security token service.
+	Response *http.Response
+
+	// Body is the raw response body.
+	Body []byte
+
+	// ErrorCode is the RFC 6749 section 5.2 "error" field, if present.
+	ErrorCode string
+
+	// ErrorDescription is the RFC 6749 section 5.2 "error_description" field, if present.
+	ErrorDescription string
+
+	// ErrorURI is the RFC 6749 section 5.2 "error_uri" field, if present.
+	ErrorURI string
+}
+
+func (e *RetrieveError) Error() string {
+	if e.ErrorCode != "" {
+		s := fmt.Sprintf("tokenexchange: %q", e.ErrorCode)
+
+		if e.ErrorDescription != "" {
+			s += fmt.Sprintf(" %q", e.ErrorDescription)
+		}
+
+		if e.ErrorURI != "" {
+			s += fmt.Sprintf(" %q", e.ErrorURI)
+		}
+
+		return s
+	}
+
+	return fmt.Sprintf("tokenexchange: cannot exchange token: %v\nResponse: %s", e.Response.Status, e.Body)
+}
+
+// SubjectTokenProvider supplies the subject token to exchange for each request, along with its
+// RFC 8693 token type. Implementations may be called once per exchange, so providers backed by
+// short-lived credentials (e.g. workload-identity tokens) can refresh the token they return.
+type SubjectTokenProvider interface {
+	// SubjectToken returns the subject token and its token-type URI to send on the next
+	// exchange request.
+	SubjectToken(ctx context.Context) (token string, tokenType string, err error)
+}
+
+// tokenSourceSubjectProvider adapts an oauth2.TokenSource into a SubjectTokenProvider, the
+// package's original behavior of exchanging whatever token the wrapped source returns.
+type tokenSourceSubjectProvider struct {
+	src       oauth2.TokenSource
+	tokenType string
+}
+
+// NewTokenSourceSubjectProvider returns a SubjectTokenProvider that exchanges the access token
+// produced by src, reporting tokenType (e.g. SubjectTokenTypeJWT) as its RFC 8693 token type.
+func NewTokenSourceSubjectProvider(src oauth2.TokenSource, tokenType string) SubjectTokenProvider {
+	return &tokenSourceSubjectProvider{src: src, tokenType: tokenType}
+}
+
+func (p *tokenSourceSubjectProvider) SubjectToken(_ context.Context) (string, string, error) {
+	token, err := p.src.Token()
+	if err != nil {
+		return "", "", err
+	}
+
+	return token.AccessToken, p.tokenType, nil
+}
+
+// fileSubjectProvider reads the subject token from a file, re-reading it on every exchange. This
+// suits workload-identity flows such as Kubernetes projected service account tokens, which are
+// rotated on disk by the kubelet.
+type fileSubjectProvider struct {
+	path      string
+	tokenType string
+}
+
+// NewFileSubjectProvider returns a SubjectTokenProvider that reads the subject token from path on
+// every exchange, reporting tokenType as its RFC 8693 token type.
+func NewFileSubjectProvider(path, tokenType string) SubjectTokenProvider {
+	return &fileSubjectProvider{path: path, tokenType: tokenType}
+}
+
+func (p *fileSubjectProvider) SubjectToken(_ context.Context) (string, string, error) {
+	data, err := os.ReadFile(p.path)
+	if err != nil {
+		return "", "", err
+	}
+
+	return strings.TrimSpace(string(data)), p.tokenType, nil
+}
+
+// staticSubjectProvider always returns the same subject token.
+type staticSubjectProvider struct {
+	token     string
+	tokenType string
+}
+
+// NewStaticSubjectProvider returns a SubjectTokenProvider that always returns token, reporting
+// tokenType as its RFC 8693 token type.
+func NewStaticSubjectProvider(token, tokenType string) SubjectTokenProvider {
+	return &staticSubjectProvider{token: token, tokenType: tokenType}
+}
+
+func (p *staticSubjectProvider) SubjectToken(_ context.Context) (string, string, error) {
+	return p.token, p.tokenType, nil
 }
 
 // Config represents a configuration for a STS-based token source.
@@ -49,37 +192,140 @@ type Config struct {
 
 	// SubjectTokenType represents the type of the subject token to send to the security token
 	// service.
+	//
+	// Deprecated: used only to build a default SubjectTokenProvider, wrapping the orig token
+	// source passed to TokenSource, when SubjectTokenProvider is unset. Set SubjectTokenProvider
+	// directly instead.
 	SubjectTokenType string
 
+	// SubjectTokenProvider supplies the subject token exchanged on every request, along with its
+	// RFC 8693 token type. If unset, TokenSource falls back to wrapping the orig token source it
+	// is given with NewTokenSourceSubjectProvider, using SubjectTokenType.
+	SubjectTokenProvider SubjectTokenProvider
+
 	// TokenURL is the URL for the security token service token endpoint.
 	TokenURL string
+
+	// Resource is the URI of the resource the requested token is intended to be used at,
+	// per RFC 8693 section 2.1. May be repeated.
+	Resource []string
+
+	// Audience identifies the logical service(s) the requested token is intended to be used
+	// with, per RFC 8693 section 2.1. May be repeated.
+	Audience []string
+
+	// Scope is the requested scope for the exchanged token. If set, it is space-joined
+	// before being sent.
+	Scope []string
+
+	// RequestedTokenType is the type of token requested from the security token service. If
+	// empty, the STS chooses a default, typically an access token.
+	RequestedTokenType string
+
+	// ActorToken is a token source for the identity of the party on whose behalf the request
+	// is being made, per RFC 8693 section 2.1 (delegation/impersonation). Optional.
+	ActorToken oauth2.TokenSource
+
+	// ActorTokenType represents the type of ActorToken. Required if ActorToken is set.
+	ActorTokenType string
+
+	// AuthStyle represents how the client ID and client secret are sent to the security token
+	// service, mirroring oauth2.AuthStyle. If zero (AuthStyleAutoDetect), the client first
+	// tries HTTP Basic auth and falls back to credentials in the request body on a 401
+	// response, caching whichever style succeeds for subsequent requests.
+	AuthStyle oauth2.AuthStyle
+
+	// OnTokenRefresh, if set, is invoked with the newly exchanged token after each successful
+	// exchange. Since oauth2.ReuseTokenSource only calls back into the underlying token source
+	// when its cached token has expired, this fires only on actual refreshes, letting
+	// applications persist the token (e.g. to a cache or database) or emit metrics.
+	OnTokenRefresh func(new *oauth2.Token)
+
+	// OnExchangeError, if set, is invoked with the error from a failed exchange. Useful for
+	// observability (metrics, traces) without wrapping the token source.
+	OnExchangeError func(error)
 }
 
-// TokenSource creates a token source that exchanges the token issued by the provided token source
-// for one issued by the configured security token service.
+// TokenSource creates a token source that exchanges the subject token supplied by the configured
+// SubjectTokenProvider for one issued by the configured security token service. If
+// SubjectTokenProvider is unset, orig is wrapped with NewTokenSourceSubjectProvider using
+// c.SubjectTokenType, matching the package's original JWT-only behavior.
 func (c *Config) TokenSource(ctx context.Context, orig oauth2.TokenSource) oauth2.TokenSource {
+	provider := c.SubjectTokenProvider
+	if provider == nil {
+		provider = NewTokenSourceSubjectProvider(orig, c.SubjectTokenType)
+	}
+
 	tokenSrc := &tokenSource{
-		ctx:              ctx,
-		clientID:         c.ClientID,
-		clientSecret:     c.ClientSecret,
-		subjectTokenType: c.SubjectTokenType,
-		tokenURL:         c.TokenURL,
+		ctx:                ctx,
+		clientID:           c.ClientID,
+		clientSecret:       c.ClientSecret,
+		subjectProvider:    provider,
+		tokenURL:           c.TokenURL,
+		resource:           c.Resource,
+		audience:           c.Audience,
+		scope:              c.Scope,
+		requestedTokenType: c.RequestedTokenType,
+		actorToken:         c.ActorToken,
+		actorTokenType:     c.ActorTokenType,
+		authStyle:          c.AuthStyle,
+		onTokenRefresh:     c.OnTokenRefresh,
+		onExchangeError:    c.OnExchangeError,
 	}
 
 	return oauth2.ReuseTokenSource(nil, tokenSrc)
 }
 
 type tokenSource struct {
-	ctx              context.Context
-	clientID         string
-	clientSecret     string
-	tokenURL         string
-	subjectTokenType string
-	origSrc          oauth2.TokenSource
+	ctx                context.Context
+	clientID           string
+	clientSecret       string
+	tokenURL           string
+	subjectProvider    SubjectTokenProvider
+	resource           []string
+	audience           []string
+	scope              []string
+	requestedTokenType string
+	actorToken         oauth2.TokenSource
+	actorTokenType     string
+	authStyle          oauth2.AuthStyle
+	refreshToken       string
+	onTokenRefresh     func(new *oauth2.Token)
+	onExchangeError    func(error)
 }
 
 func (t *tokenSource) Token() (*oauth2.Token, error) {
-	return t.exchangeToken()
+	if t.refreshToken != "" {
+		token, err := t.withCallbacks(t.refreshAccessToken)
+		if err == nil {
+			return token, nil
+		}
+
+		// The cached refresh token didn't work (likely expired or revoked); fall back to a
+		// full subject-token exchange below.
+		t.refreshToken = ""
+	}
+
+	return t.withCallbacks(t.doExchangeToken)
+}
+
+// withCallbacks invokes fn and reports its outcome via OnTokenRefresh/OnExchangeError, so both
+// the subject-token exchange path and the refresh-token path observe the same hooks.
+func (t *tokenSource) withCallbacks(fn func() (*oauth2.Token, error)) (*oauth2.Token, error) {
+	token, err := fn()
+	if err != nil {
+		if t.onExchangeError != nil {
+			t.onExchangeError(err)
+		}
+
+		return nil, err
+	}
+
+	if t.onTokenRefresh != nil {
+		t.onTokenRefresh(token)
+	}
+
+	return token, nil
 }
 
 func getHTTPClient(ctx context.Context) *http.Client {
@@ -97,6 +343,23 @@ func buildTokenFromResponse(resp *http.Response) (*oauth2.Token, error) {
 		return nil, err
 	}
 
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		retrieveErr := &RetrieveError{
+			Response: resp,
+			Body:     bodyBytes,
+		}
+
+		var errResponse tokenExchangeErrorResponse
+
+		if err := json.Unmarshal(bodyBytes, &errResponse); err == nil {
+			retrieveErr.ErrorCode = errResponse.ErrorCode
+			retrieveErr.ErrorDescription = errResponse.ErrorDescription
+			retrieveErr.ErrorURI = errResponse.ErrorURI
+		}
+
+		return nil, retrieveErr
+	}
+
 	var tokenResponse tokenExchangeResponse
 
 	if err := json.Unmarshal(bodyBytes, &tokenResponse); err != nil {
@@ -108,12 +371,47 @@ func buildTokenFromResponse(resp *http.Response) (*oauth2.Token, error) {
 	out.AccessToken = tokenResponse.AccessToken
 	out.TokenType = tokenResponse.TokenType
 	out.Expiry = time.Now().Add(time.Duration(tokenResponse.ExpiresIn) * time.Second)
+	out.RefreshToken = tokenResponse.RefreshToken
 
 	return &out, nil
 }
 
-func (t *tokenSource) buildExchangeRequest() (*http.Request, error) {
-	token, err := t.origSrc.Token()
+// authStyleToUse returns the auth style this request should be sent with. When authStyle is
+// AuthStyleAutoDetect, it defaults to AuthStyleInHeader for the first attempt; a failed attempt
+// is retried once with AuthStyleInParams, per the auto-detect behavior in x/oauth2.
+func (t *tokenSource) authStyleToUse() oauth2.AuthStyle {
+	if t.authStyle == oauth2.AuthStyleInParams {
+		return oauth2.AuthStyleInParams
+	}
+
+	return oauth2.AuthStyleInHeader
+}
+
+func (t *tokenSource) newRequest(values url.Values, style oauth2.AuthStyle) (*http.Request, error) {
+	if t.clientID != "" && style == oauth2.AuthStyleInParams {
+		values.Set("client_id", t.clientID)
+
+		if t.clientSecret != "" {
+			values.Set("client_secret", t.clientSecret)
+		}
+	}
+
+	valuesReader := strings.NewReader(values.Encode())
+
+	req, err := http.NewRequestWithContext(t.ctx, http.MethodPost, t.tokenURL, valuesReader)
+	if err != nil {
+		return nil, err
+	}
+
+	if t.clientID != "" && style == oauth2.AuthStyleInHeader {
+		req.SetBasicAuth(url.QueryEscape(t.clientID), url.QueryEscape(t.clientSecret))
+	}
+
+	return req, nil
+}
+
+func (t *tokenSource) exchangeValues() (url.Values, error) {
+	subjectToken, subjectTokenType, err := t.subjectProvider.SubjectToken(t.ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -121,28 +419,140 @@ func (t *tokenSource) buildExchangeRequest() (*http.Request, error) {
 	values := url.Values{}
 
 	values.Set(paramGrantType, grantTypeExchange)
-	values.Set(paramSubjectToken, token.AccessToken)
-	values.Set(paramSubjectTokenType, t.subjectTokenType)
+	values.Set(paramSubjectToken, subjectToken)
+	values.Set(paramSubjectTokenType, subjectTokenType)
 
-	valuesReader := strings.NewReader(values.Encode())
+	for _, resource := range t.resource {
+		values.Add(paramResource, resource)
+	}
+
+	for _, audience := range t.audience {
+		values.Add(paramAudience, audience)
+	}
+
+	if len(t.scope) > 0 {
+		values.Set(paramScope, strings.Join(t.scope, " "))
+	}
+
+	if t.requestedTokenType != "" {
+		values.Set(paramRequestedTokenType, t.requestedTokenType)
+	}
+
+	if t.actorToken != nil {
+		actorToken, err := t.actorToken.Token()
+		if err != nil {
+			return nil, err
+		}
+
+		values.Set(paramActorToken, actorToken.AccessToken)
+		values.Set(paramActorTokenType, t.actorTokenType)
+	}
 
-	return http.NewRequestWithContext(t.ctx, http.MethodPost, t.tokenURL, valuesReader)
+	return values, nil
 }
 
-func (t *tokenSource) exchangeToken() (*oauth2.Token, error) {
-	request, err := t.buildExchangeRequest()
+// doRequest posts values to the token endpoint, applying client authentication and retrying
+// once with AuthStyleInParams if an AuthStyleAutoDetect request is rejected with a 401. It
+// reports the style actually used for the (possibly retried) request and whether a retry
+// occurred; the caller is responsible for caching that style, and should only do so once the
+// response has been confirmed a success, mirroring x/oauth2's styleCache semantics.
+func (t *tokenSource) doRequest(values url.Values) (resp *http.Response, style oauth2.AuthStyle, retried bool, err error) {
+	client := getHTTPClient(t.ctx)
+
+	style = t.authStyleToUse()
+
+	req, err := t.newRequest(values, style)
+	if err != nil {
+		return nil, style, false, err
+	}
+
+	resp, err = client.Do(req)
+	if err != nil {
+		return nil, style, false, err
+	}
+
+	if resp.StatusCode == http.StatusUnauthorized && t.authStyle == oauth2.AuthStyleAutoDetect && style == oauth2.AuthStyleInHeader {
+		resp.Body.Close()
+
+		style = oauth2.AuthStyleInParams
+		retried = true
+
+		req, err = t.newRequest(values, style)
+		if err != nil {
+			return nil, style, retried, err
+		}
+
+		resp, err = client.Do(req)
+		if err != nil {
+			return nil, style, retried, err
+		}
+	}
+
+	return resp, style, retried, nil
+}
+
+// cacheAuthStyle pins authStyle to style once a retried AuthStyleAutoDetect request has
+// succeeded, so subsequent requests skip straight to the style that worked.
+func (t *tokenSource) cacheAuthStyle(style oauth2.AuthStyle, retried bool) {
+	if retried && t.authStyle == oauth2.AuthStyleAutoDetect {
+		t.authStyle = style
+	}
+}
+
+func (t *tokenSource) doExchangeToken() (*oauth2.Token, error) {
+	values, err := t.exchangeValues()
 	if err != nil {
 		return nil, err
 	}
 
-	client := getHTTPClient(t.ctx)
+	resp, style, retried, err := t.doRequest(values)
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	token, err := buildTokenFromResponse(resp)
+	if err != nil {
+		return nil, err
+	}
+
+	t.cacheAuthStyle(style, retried)
+
+	t.refreshToken = token.RefreshToken
+
+	return token, nil
+}
+
+// refreshAccessToken performs a standard RFC 6749 section 6 refresh_token grant against
+// TokenURL using the cached refresh token issued alongside a prior exchange, per RFC 8693
+// section 2.2.1. This avoids re-exchanging the subject token on every expiry once the STS has
+// handed out a refresh credential.
+func (t *tokenSource) refreshAccessToken() (*oauth2.Token, error) {
+	values := url.Values{}
 
-	resp, err := client.Do(request)
+	values.Set(paramGrantType, grantTypeRefreshToken)
+	values.Set(paramRefreshToken, t.refreshToken)
+
+	resp, style, retried, err := t.doRequest(values)
 	if err != nil {
 		return nil, err
 	}
 
 	defer resp.Body.Close()
 
-	return buildTokenFromResponse(resp)
+	token, err := buildTokenFromResponse(resp)
+	if err != nil {
+		return nil, err
+	}
+
+	t.cacheAuthStyle(style, retried)
+
+	if token.RefreshToken == "" {
+		token.RefreshToken = t.refreshToken
+	}
+
+	t.refreshToken = token.RefreshToken
+
+	return token, nil
 }
@@ -0,0 +1,672 @@
+package tokenexchange
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/oauth2"
+)
+
+func TestAuthStyleAutoDetectRetriesWithParams(t *testing.T) {
+	var attempts int
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Fatalf("reading request body: %v", err)
+		}
+
+		values, err := url.ParseQuery(string(body))
+		if err != nil {
+			t.Fatalf("parsing request body: %v", err)
+		}
+
+		switch attempts {
+		case 1:
+			if _, _, ok := r.BasicAuth(); !ok {
+				t.Errorf("attempt 1: expected HTTP Basic auth header, got none")
+			}
+
+			if values.Get("client_id") != "" {
+				t.Errorf("attempt 1: expected no client_id in body, got %q", values.Get("client_id"))
+			}
+
+			w.WriteHeader(http.StatusUnauthorized)
+		default:
+			if values.Get("client_id") != "test-client" {
+				t.Errorf("attempt %d: expected client_id in body, got %q", attempts, values.Get("client_id"))
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"access_token":"exchanged","token_type":"Bearer","expires_in":3600}`))
+		}
+	}))
+	defer server.Close()
+
+	ts := &tokenSource{
+		ctx:             context.Background(),
+		clientID:        "test-client",
+		clientSecret:    "test-secret",
+		tokenURL:        server.URL,
+		subjectProvider: NewStaticSubjectProvider("subject-token", SubjectTokenTypeJWT),
+		authStyle:       oauth2.AuthStyleAutoDetect,
+	}
+
+	token, err := ts.Token()
+	if err != nil {
+		t.Fatalf("Token() returned error: %v", err)
+	}
+
+	if token.AccessToken != "exchanged" {
+		t.Errorf("AccessToken = %q, want %q", token.AccessToken, "exchanged")
+	}
+
+	if attempts != 2 {
+		t.Fatalf("expected 2 requests (basic, then params retry), got %d", attempts)
+	}
+
+	if ts.authStyle != oauth2.AuthStyleInParams {
+		t.Errorf("authStyle = %v, want AuthStyleInParams after a successful retry", ts.authStyle)
+	}
+
+	if _, err := ts.Token(); err != nil {
+		t.Fatalf("second Token() call returned error: %v", err)
+	}
+
+	if attempts != 3 {
+		t.Fatalf("expected the cached auth style to skip the 401 retry on the next call, got %d total requests", attempts)
+	}
+}
+
+func TestAuthStyleNotCachedWhenRetryAlsoFails(t *testing.T) {
+	var attempts int
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+
+		w.WriteHeader(http.StatusBadRequest)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"error":"invalid_grant"}`))
+	}))
+	defer server.Close()
+
+	ts := &tokenSource{
+		ctx:             context.Background(),
+		clientID:        "test-client",
+		clientSecret:    "test-secret",
+		tokenURL:        server.URL,
+		subjectProvider: NewStaticSubjectProvider("subject-token", SubjectTokenTypeJWT),
+		authStyle:       oauth2.AuthStyleAutoDetect,
+	}
+
+	if _, err := ts.Token(); err == nil {
+		t.Fatal("expected an error, got nil")
+	}
+
+	if attempts != 1 {
+		t.Fatalf("expected a single request (a non-401 error does not trigger a retry), got %d", attempts)
+	}
+
+	if ts.authStyle != oauth2.AuthStyleAutoDetect {
+		t.Errorf("authStyle = %v, want it to remain AuthStyleAutoDetect after a non-401 failure", ts.authStyle)
+	}
+}
+
+func TestAuthStyleNotCachedWhenRetriedRequestAlsoUnauthorized(t *testing.T) {
+	var attempts int
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"error":"invalid_client"}`))
+	}))
+	defer server.Close()
+
+	ts := &tokenSource{
+		ctx:             context.Background(),
+		clientID:        "test-client",
+		clientSecret:    "test-secret",
+		tokenURL:        server.URL,
+		subjectProvider: NewStaticSubjectProvider("subject-token", SubjectTokenTypeJWT),
+		authStyle:       oauth2.AuthStyleAutoDetect,
+	}
+
+	if _, err := ts.Token(); err == nil {
+		t.Fatal("expected an error, got nil")
+	}
+
+	if attempts != 2 {
+		t.Fatalf("expected the 401 to trigger exactly one retry with AuthStyleInParams, got %d requests", attempts)
+	}
+
+	if ts.authStyle != oauth2.AuthStyleAutoDetect {
+		t.Errorf("authStyle = %v, want it to remain AuthStyleAutoDetect when the retried request also fails", ts.authStyle)
+	}
+
+	if _, err := ts.Token(); err == nil {
+		t.Fatal("expected an error on the second call, got nil")
+	}
+
+	if attempts != 4 {
+		t.Fatalf("expected the second call to also retry (style was never cached), got %d total requests", attempts)
+	}
+}
+
+func TestExchangeValuesIncludesFullParameterSurface(t *testing.T) {
+	ts := &tokenSource{
+		ctx:                context.Background(),
+		subjectProvider:    NewStaticSubjectProvider("subject-token", SubjectTokenTypeJWT),
+		resource:           []string{"https://resource-a.example", "https://resource-b.example"},
+		audience:           []string{"aud-a", "aud-b"},
+		scope:              []string{"read", "write"},
+		requestedTokenType: SubjectTokenTypeAccessToken,
+		actorToken:         oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "actor-token"}),
+		actorTokenType:     SubjectTokenTypeJWT,
+	}
+
+	values, err := ts.exchangeValues()
+	if err != nil {
+		t.Fatalf("exchangeValues() returned error: %v", err)
+	}
+
+	if got := values.Get(paramGrantType); got != grantTypeExchange {
+		t.Errorf("grant_type = %q, want %q", got, grantTypeExchange)
+	}
+
+	if got := values.Get(paramSubjectToken); got != "subject-token" {
+		t.Errorf("subject_token = %q, want %q", got, "subject-token")
+	}
+
+	if got := values.Get(paramSubjectTokenType); got != SubjectTokenTypeJWT {
+		t.Errorf("subject_token_type = %q, want %q", got, SubjectTokenTypeJWT)
+	}
+
+	if got := values[paramResource]; !reflect.DeepEqual(got, ts.resource) {
+		t.Errorf("resource = %v, want %v", got, ts.resource)
+	}
+
+	if got := values[paramAudience]; !reflect.DeepEqual(got, ts.audience) {
+		t.Errorf("audience = %v, want %v", got, ts.audience)
+	}
+
+	if got := values.Get(paramScope); got != "read write" {
+		t.Errorf("scope = %q, want %q", got, "read write")
+	}
+
+	if got := values.Get(paramRequestedTokenType); got != SubjectTokenTypeAccessToken {
+		t.Errorf("requested_token_type = %q, want %q", got, SubjectTokenTypeAccessToken)
+	}
+
+	if got := values.Get(paramActorToken); got != "actor-token" {
+		t.Errorf("actor_token = %q, want %q", got, "actor-token")
+	}
+
+	if got := values.Get(paramActorTokenType); got != SubjectTokenTypeJWT {
+		t.Errorf("actor_token_type = %q, want %q", got, SubjectTokenTypeJWT)
+	}
+}
+
+type errTokenSource struct {
+	err error
+}
+
+func (e errTokenSource) Token() (*oauth2.Token, error) {
+	return nil, e.err
+}
+
+func TestExchangeValuesPropagatesActorTokenError(t *testing.T) {
+	wantErr := errors.New("actor token unavailable")
+
+	ts := &tokenSource{
+		ctx:             context.Background(),
+		subjectProvider: NewStaticSubjectProvider("subject-token", SubjectTokenTypeJWT),
+		actorToken:      errTokenSource{err: wantErr},
+		actorTokenType:  SubjectTokenTypeJWT,
+	}
+
+	if _, err := ts.exchangeValues(); !errors.Is(err, wantErr) {
+		t.Fatalf("exchangeValues() error = %v, want %v", err, wantErr)
+	}
+}
+
+func TestTokenUsesCachedRefreshTokenInsteadOfExchange(t *testing.T) {
+	var exchanges, refreshes int
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Fatalf("reading request body: %v", err)
+		}
+
+		values, err := url.ParseQuery(string(body))
+		if err != nil {
+			t.Fatalf("parsing request body: %v", err)
+		}
+
+		switch values.Get(paramGrantType) {
+		case grantTypeRefreshToken:
+			refreshes++
+
+			if values.Get(paramRefreshToken) != "cached-refresh" {
+				t.Errorf("refresh_token = %q, want %q", values.Get(paramRefreshToken), "cached-refresh")
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"access_token":"refreshed","token_type":"Bearer","expires_in":3600}`))
+		default:
+			exchanges++
+
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"access_token":"exchanged","token_type":"Bearer","expires_in":3600}`))
+		}
+	}))
+	defer server.Close()
+
+	ts := &tokenSource{
+		ctx:             context.Background(),
+		tokenURL:        server.URL,
+		subjectProvider: NewStaticSubjectProvider("subject-token", SubjectTokenTypeJWT),
+		refreshToken:    "cached-refresh",
+	}
+
+	token, err := ts.Token()
+	if err != nil {
+		t.Fatalf("Token() returned error: %v", err)
+	}
+
+	if token.AccessToken != "refreshed" {
+		t.Errorf("AccessToken = %q, want %q", token.AccessToken, "refreshed")
+	}
+
+	if refreshes != 1 || exchanges != 0 {
+		t.Fatalf("expected a single refresh request and no subject-token exchange, got %d refreshes, %d exchanges", refreshes, exchanges)
+	}
+}
+
+func TestTokenFallsBackToExchangeWhenRefreshTokenFails(t *testing.T) {
+	var exchanges, refreshes int
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Fatalf("reading request body: %v", err)
+		}
+
+		values, err := url.ParseQuery(string(body))
+		if err != nil {
+			t.Fatalf("parsing request body: %v", err)
+		}
+
+		switch values.Get(paramGrantType) {
+		case grantTypeRefreshToken:
+			refreshes++
+
+			w.WriteHeader(http.StatusBadRequest)
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"error":"invalid_grant"}`))
+		default:
+			exchanges++
+
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"access_token":"exchanged","token_type":"Bearer","expires_in":3600}`))
+		}
+	}))
+	defer server.Close()
+
+	ts := &tokenSource{
+		ctx:             context.Background(),
+		tokenURL:        server.URL,
+		subjectProvider: NewStaticSubjectProvider("subject-token", SubjectTokenTypeJWT),
+		refreshToken:    "expired-refresh",
+	}
+
+	token, err := ts.Token()
+	if err != nil {
+		t.Fatalf("Token() returned error: %v", err)
+	}
+
+	if token.AccessToken != "exchanged" {
+		t.Errorf("AccessToken = %q, want %q", token.AccessToken, "exchanged")
+	}
+
+	if refreshes != 1 || exchanges != 1 {
+		t.Fatalf("expected one failed refresh followed by one exchange, got %d refreshes, %d exchanges", refreshes, exchanges)
+	}
+
+	if ts.refreshToken != "" {
+		t.Errorf("refreshToken = %q, want cleared after falling back to a fresh exchange with no refresh_token in the response", ts.refreshToken)
+	}
+}
+
+func TestRefreshResponseWithoutRefreshTokenPreservesCachedOne(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token":"refreshed","token_type":"Bearer","expires_in":3600}`))
+	}))
+	defer server.Close()
+
+	ts := &tokenSource{
+		ctx:             context.Background(),
+		tokenURL:        server.URL,
+		subjectProvider: NewStaticSubjectProvider("subject-token", SubjectTokenTypeJWT),
+		refreshToken:    "original-refresh",
+	}
+
+	if _, err := ts.Token(); err != nil {
+		t.Fatalf("Token() returned error: %v", err)
+	}
+
+	if ts.refreshToken != "original-refresh" {
+		t.Errorf("refreshToken = %q, want the previously cached refresh token to be preserved", ts.refreshToken)
+	}
+}
+
+func TestBuildTokenFromResponseParsesOAuthError(t *testing.T) {
+	resp := &http.Response{
+		StatusCode: http.StatusBadRequest,
+		Body:       io.NopCloser(strings.NewReader(`{"error":"invalid_grant","error_description":"subject token expired"}`)),
+	}
+
+	_, err := buildTokenFromResponse(resp)
+	if err == nil {
+		t.Fatal("expected an error, got nil")
+	}
+
+	var retrieveErr *RetrieveError
+	if !errors.As(err, &retrieveErr) {
+		t.Fatalf("error is %T, want *RetrieveError", err)
+	}
+
+	if retrieveErr.ErrorCode != "invalid_grant" {
+		t.Errorf("ErrorCode = %q, want %q", retrieveErr.ErrorCode, "invalid_grant")
+	}
+
+	if retrieveErr.ErrorDescription != "subject token expired" {
+		t.Errorf("ErrorDescription = %q, want %q", retrieveErr.ErrorDescription, "subject token expired")
+	}
+
+	if retrieveErr.Response != resp {
+		t.Error("Response does not match the original *http.Response")
+	}
+
+	if string(retrieveErr.Body) != `{"error":"invalid_grant","error_description":"subject token expired"}` {
+		t.Errorf("Body = %q, want the raw response body", retrieveErr.Body)
+	}
+}
+
+func TestBuildTokenFromResponseHandlesOpaqueErrorBody(t *testing.T) {
+	resp := &http.Response{
+		Status:     "502 Bad Gateway",
+		StatusCode: http.StatusBadGateway,
+		Body:       io.NopCloser(strings.NewReader("upstream connection reset")),
+	}
+
+	_, err := buildTokenFromResponse(resp)
+	if err == nil {
+		t.Fatal("expected an error, got nil")
+	}
+
+	var retrieveErr *RetrieveError
+	if !errors.As(err, &retrieveErr) {
+		t.Fatalf("error is %T, want *RetrieveError", err)
+	}
+
+	if retrieveErr.ErrorCode != "" {
+		t.Errorf("ErrorCode = %q, want empty for a non-JSON body", retrieveErr.ErrorCode)
+	}
+
+	if retrieveErr.Response != resp {
+		t.Error("Response does not match the original *http.Response")
+	}
+
+	if string(retrieveErr.Body) != "upstream connection reset" {
+		t.Errorf("Body = %q, want the raw response body", retrieveErr.Body)
+	}
+
+	if retrieveErr.Error() == "" {
+		t.Error("Error() returned an empty string for an opaque error body")
+	}
+}
+
+func TestCallbacksFireOnExchangeSuccessAndFailure(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("fail") == "true" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"error":"invalid_grant"}`))
+
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token":"exchanged","token_type":"Bearer","expires_in":3600}`))
+	}))
+	defer server.Close()
+
+	var (
+		refreshed []*oauth2.Token
+		failed    []error
+	)
+
+	ts := &tokenSource{
+		ctx:             context.Background(),
+		tokenURL:        server.URL,
+		subjectProvider: NewStaticSubjectProvider("subject-token", SubjectTokenTypeJWT),
+		onTokenRefresh:  func(new *oauth2.Token) { refreshed = append(refreshed, new) },
+		onExchangeError: func(err error) { failed = append(failed, err) },
+	}
+
+	token, err := ts.Token()
+	if err != nil {
+		t.Fatalf("Token() returned error: %v", err)
+	}
+
+	if len(refreshed) != 1 || refreshed[0].AccessToken != token.AccessToken {
+		t.Fatalf("onTokenRefresh calls = %v, want exactly one call with the exchanged token", refreshed)
+	}
+
+	if len(failed) != 0 {
+		t.Fatalf("onExchangeError calls = %v, want none on a successful exchange", failed)
+	}
+
+	ts.tokenURL = server.URL + "?fail=true"
+
+	if _, err := ts.Token(); err == nil {
+		t.Fatal("expected an error, got nil")
+	}
+
+	if len(failed) != 1 {
+		t.Fatalf("onExchangeError calls = %d, want exactly one call on a failed exchange", len(failed))
+	}
+
+	if len(refreshed) != 1 {
+		t.Fatalf("onTokenRefresh calls = %d, want still exactly one call after the failed exchange", len(refreshed))
+	}
+}
+
+func TestCallbacksFireOnRefreshSuccessAndFallback(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Fatalf("reading request body: %v", err)
+		}
+
+		values, err := url.ParseQuery(string(body))
+		if err != nil {
+			t.Fatalf("parsing request body: %v", err)
+		}
+
+		if values.Get(paramGrantType) == grantTypeRefreshToken {
+			if values.Get(paramRefreshToken) == "good-refresh" {
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(`{"access_token":"refreshed","token_type":"Bearer","expires_in":3600}`))
+
+				return
+			}
+
+			w.WriteHeader(http.StatusBadRequest)
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"error":"invalid_grant"}`))
+
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token":"exchanged","token_type":"Bearer","expires_in":3600}`))
+	}))
+	defer server.Close()
+
+	var (
+		refreshed []*oauth2.Token
+		failed    []error
+	)
+
+	ts := &tokenSource{
+		ctx:             context.Background(),
+		tokenURL:        server.URL,
+		subjectProvider: NewStaticSubjectProvider("subject-token", SubjectTokenTypeJWT),
+		refreshToken:    "good-refresh",
+		onTokenRefresh:  func(new *oauth2.Token) { refreshed = append(refreshed, new) },
+		onExchangeError: func(err error) { failed = append(failed, err) },
+	}
+
+	token, err := ts.Token()
+	if err != nil {
+		t.Fatalf("Token() returned error: %v", err)
+	}
+
+	if len(refreshed) != 1 || refreshed[0].AccessToken != token.AccessToken || token.AccessToken != "refreshed" {
+		t.Fatalf("onTokenRefresh calls = %v, want exactly one call with the refreshed token", refreshed)
+	}
+
+	if len(failed) != 0 {
+		t.Fatalf("onExchangeError calls = %v, want none on a successful refresh", failed)
+	}
+
+	ts.refreshToken = "bad-refresh"
+
+	token, err = ts.Token()
+	if err != nil {
+		t.Fatalf("Token() returned error: %v", err)
+	}
+
+	if token.AccessToken != "exchanged" {
+		t.Fatalf("AccessToken = %q, want the fallback exchange's token", token.AccessToken)
+	}
+
+	if len(failed) != 1 {
+		t.Fatalf("onExchangeError calls = %d, want exactly one call for the failed refresh", len(failed))
+	}
+
+	if len(refreshed) != 2 {
+		t.Fatalf("onTokenRefresh calls = %d, want a second call for the fallback exchange", len(refreshed))
+	}
+}
+
+func TestFileSubjectProviderTrimsTrailingNewline(t *testing.T) {
+	f, err := os.CreateTemp(t.TempDir(), "subject-token")
+	if err != nil {
+		t.Fatalf("creating temp file: %v", err)
+	}
+
+	if _, err := f.WriteString("file-token\n"); err != nil {
+		t.Fatalf("writing temp file: %v", err)
+	}
+
+	if err := f.Close(); err != nil {
+		t.Fatalf("closing temp file: %v", err)
+	}
+
+	provider := NewFileSubjectProvider(f.Name(), SubjectTokenTypeJWT)
+
+	token, tokenType, err := provider.SubjectToken(context.Background())
+	if err != nil {
+		t.Fatalf("SubjectToken() returned error: %v", err)
+	}
+
+	if token != "file-token" {
+		t.Errorf("token = %q, want the trailing newline trimmed to %q", token, "file-token")
+	}
+
+	if tokenType != SubjectTokenTypeJWT {
+		t.Errorf("tokenType = %q, want %q", tokenType, SubjectTokenTypeJWT)
+	}
+}
+
+func TestStaticSubjectProviderReturnsConfiguredValues(t *testing.T) {
+	provider := NewStaticSubjectProvider("static-token", SubjectTokenTypeAccessToken)
+
+	for i := 0; i < 2; i++ {
+		token, tokenType, err := provider.SubjectToken(context.Background())
+		if err != nil {
+			t.Fatalf("SubjectToken() returned error: %v", err)
+		}
+
+		if token != "static-token" {
+			t.Errorf("token = %q, want %q", token, "static-token")
+		}
+
+		if tokenType != SubjectTokenTypeAccessToken {
+			t.Errorf("tokenType = %q, want %q", tokenType, SubjectTokenTypeAccessToken)
+		}
+	}
+}
+
+// TestConfigTokenSourceWiresOrigTokenSource guards against a regression of the bug where
+// Config.TokenSource never assigned orig to the resulting tokenSource, making the package
+// nil-panic on first use.
+func TestConfigTokenSourceWiresOrigTokenSource(t *testing.T) {
+	var gotSubjectToken string
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Fatalf("reading request body: %v", err)
+		}
+
+		values, err := url.ParseQuery(string(body))
+		if err != nil {
+			t.Fatalf("parsing request body: %v", err)
+		}
+
+		gotSubjectToken = values.Get(paramSubjectToken)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token":"exchanged","token_type":"Bearer","expires_in":3600}`))
+	}))
+	defer server.Close()
+
+	cfg := &Config{
+		TokenURL:         server.URL,
+		SubjectTokenType: SubjectTokenTypeJWT,
+	}
+
+	orig := oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "orig-access-token"})
+
+	src := cfg.TokenSource(context.Background(), orig)
+
+	token, err := src.Token()
+	if err != nil {
+		t.Fatalf("Token() returned error: %v", err)
+	}
+
+	if token.AccessToken != "exchanged" {
+		t.Errorf("AccessToken = %q, want %q", token.AccessToken, "exchanged")
+	}
+
+	if gotSubjectToken != "orig-access-token" {
+		t.Errorf("subject_token sent to the STS = %q, want orig's token %q", gotSubjectToken, "orig-access-token")
+	}
+}